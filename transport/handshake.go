@@ -0,0 +1,136 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"nanomsg.org/go-mangos"
+)
+
+// Handshaker accepts raw, not yet negotiated pipes and performs the SP
+// handshake for each of them in its own goroutine, so that a slow or
+// hostile peer cannot stall a listener's Accept loop.  Fully negotiated
+// pipes are delivered to callers of Next in the order they complete,
+// which is not necessarily the order they were started in.
+type Handshaker struct {
+	timeout time.Duration
+	readyq  chan mangos.TranPipe
+	closeq  chan struct{}
+	closeMx sync.Mutex
+	closed  bool
+}
+
+// NewHandshaker creates a Handshaker that waits at most timeout for each
+// pipe it is given to complete its handshake.  A timeout of zero means
+// wait forever.
+func NewHandshaker(timeout time.Duration) *Handshaker {
+	return &Handshaker{
+		timeout: timeout,
+		readyq:  make(chan mangos.TranPipe),
+		closeq:  make(chan struct{}),
+	}
+}
+
+// Start queues a raw pipe for handshaking.  conn is the raw connection
+// that fn's negotiation reads and writes on; if the handshake does not
+// complete within the configured timeout, the Handshaker closes conn
+// itself so that whatever blocking read fn is stuck in is unblocked and
+// fn can return.  fn is called in a new goroutine to perform the actual
+// negotiation (typically a call to mangos.NewConnPipeIPCNoHandshake's
+// handshake, or the transport's equivalent).  Start never blocks.
+func (h *Handshaker) Start(conn io.Closer, fn func() (mangos.TranPipe, error)) {
+	go h.negotiate(conn, fn)
+}
+
+// Next blocks until a fully negotiated pipe is ready, or the Handshaker
+// is closed, in which case it returns mangos.ErrClosed.
+func (h *Handshaker) Next() (mangos.TranPipe, error) {
+	select {
+	case p := <-h.readyq:
+		return p, nil
+	case <-h.closeq:
+		return nil, mangos.ErrClosed
+	}
+}
+
+func (h *Handshaker) negotiate(conn io.Closer, fn func() (mangos.TranPipe, error)) {
+	done := make(chan struct{})
+	var p mangos.TranPipe
+	var err error
+
+	go func() {
+		p, err = fn()
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if h.timeout > 0 {
+		timer := time.NewTimer(h.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	aborted := false
+	select {
+	case <-done:
+	case <-expired:
+		// The handshake took too long.  Close the raw conn so that
+		// whatever blocking read/write fn is stuck in (typically
+		// the 4-byte SP negotiation) is forced to unblock and
+		// return, instead of leaking fn's goroutine and the open
+		// pipe handle forever.
+		conn.Close()
+		<-done
+		aborted = true
+	case <-h.closeq:
+		// The Handshaker is being shut down; a handshake stuck
+		// reading/writing on conn would otherwise leak past Close,
+		// same as the timeout case above.
+		conn.Close()
+		<-done
+		aborted = true
+	}
+
+	if err != nil {
+		return
+	}
+	if aborted {
+		// fn may have finished just as the timer fired or Close was
+		// called, but its conn is closed now, so the pipe is dropped.
+		p.Close()
+		return
+	}
+	select {
+	case h.readyq <- p:
+	case <-h.closeq:
+		p.Close()
+	}
+}
+
+// Close shuts the Handshaker down.  Handshakes still in flight have
+// their raw conn closed, pipes whose handshake has already finished are
+// closed instead of being delivered, and any blocked Next calls return
+// mangos.ErrClosed.
+func (h *Handshaker) Close() {
+	h.closeMx.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.closeq)
+	}
+	h.closeMx.Unlock()
+}
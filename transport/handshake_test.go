@@ -0,0 +1,189 @@
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nanomsg.org/go-mangos"
+)
+
+// fakeConn is a stand-in for the raw net.Conn a real handshake would
+// read and write on; it only needs to be closeable.
+type fakeConn struct {
+	closed int32
+}
+
+func (c *fakeConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+// fakePipe is a stand-in for a negotiated mangos.TranPipe.
+type fakePipe struct {
+	closed int32
+}
+
+func (p *fakePipe) Recv() (*mangos.Message, error)      { return nil, nil }
+func (p *fakePipe) Send(*mangos.Message) error          { return nil }
+func (p *fakePipe) LocalProtocol() uint16               { return 0 }
+func (p *fakePipe) RemoteProtocol() uint16              { return 0 }
+func (p *fakePipe) IsOpen() bool                        { return atomic.LoadInt32(&p.closed) == 0 }
+func (p *fakePipe) GetProp(string) (interface{}, error) { return nil, mangos.ErrBadOption }
+func (p *fakePipe) Close() error {
+	atomic.StoreInt32(&p.closed, 1)
+	return nil
+}
+
+func (p *fakePipe) isClosed() bool {
+	return atomic.LoadInt32(&p.closed) != 0
+}
+
+const testWait = time.Second
+
+func TestHandshakerNextDeliversReadyPipe(t *testing.T) {
+	h := NewHandshaker(0)
+	defer h.Close()
+
+	pipe := &fakePipe{}
+	h.Start(&fakeConn{}, func() (mangos.TranPipe, error) {
+		return pipe, nil
+	})
+
+	select {
+	case p := <-waitNext(h):
+		if p.pipe != pipe || p.err != nil {
+			t.Fatalf("Next() = %v, %v; want %v, nil", p.pipe, p.err, pipe)
+		}
+	case <-time.After(testWait):
+		t.Fatal("Next() did not return a ready pipe in time")
+	}
+}
+
+func TestHandshakerTimeoutClosesConnAndDropsPipe(t *testing.T) {
+	h := NewHandshaker(20 * time.Millisecond)
+	defer h.Close()
+
+	conn := &fakeConn{}
+	blocked := make(chan struct{})
+	h.Start(conn, func() (mangos.TranPipe, error) {
+		<-blocked
+		return nil, errors.New("handshake aborted")
+	})
+
+	deadline := time.Now().Add(testWait)
+	for !conn.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed-out negotiate never closed the raw conn")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(blocked)
+
+	select {
+	case p := <-waitNext(h):
+		t.Fatalf("Next() unexpectedly delivered a pipe for a timed-out handshake: %v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandshakerCloseUnblocksPendingNext(t *testing.T) {
+	h := NewHandshaker(0)
+
+	next := waitNext(h)
+	h.Close()
+
+	select {
+	case p := <-next:
+		if p.err != mangos.ErrClosed {
+			t.Fatalf("Next() err = %v, want mangos.ErrClosed", p.err)
+		}
+	case <-time.After(testWait):
+		t.Fatal("Close() did not unblock a pending Next()")
+	}
+}
+
+func TestHandshakerCloseUnblocksInFlightNegotiate(t *testing.T) {
+	h := NewHandshaker(0)
+
+	pipe := &fakePipe{}
+	done := make(chan struct{})
+	h.Start(&fakeConn{}, func() (mangos.TranPipe, error) {
+		return pipe, nil
+	})
+	go func() {
+		// Never drain readyq, so negotiate is left blocked trying to
+		// hand the finished pipe to Next.
+		h.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(testWait):
+		t.Fatal("Close() did not return")
+	}
+
+	deadline := time.Now().Add(testWait)
+	for !pipe.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("Close() did not unblock the in-flight negotiate's pipe handoff")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandshakerCloseClosesConnOfStuckHandshake(t *testing.T) {
+	h := NewHandshaker(0)
+
+	conn := &fakeConn{}
+	blocked := make(chan struct{})
+	h.Start(conn, func() (mangos.TranPipe, error) {
+		<-blocked
+		return nil, errors.New("handshake aborted")
+	})
+
+	h.Close()
+
+	deadline := time.Now().Add(testWait)
+	for !conn.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("Close() never closed the conn of a still in-flight handshake")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(blocked)
+}
+
+type nextResult struct {
+	pipe mangos.TranPipe
+	err  error
+}
+
+func waitNext(h *Handshaker) <-chan nextResult {
+	c := make(chan nextResult, 1)
+	go func() {
+		p, err := h.Next()
+		c <- nextResult{p, err}
+	}()
+	return c
+}
@@ -15,12 +15,25 @@
 // limitations under the License.
 
 // Package ipc implements the IPC transport on top of Windows Named Pipes.
+//
+// Accept is non-blocking: raw pipes are handed off to a
+// transport.Handshaker which performs the SP handshake off the accept
+// goroutine (see Handshaker in the transport package).  The POSIX ipc
+// transport and other stream transports (tcp, tls) are not present in
+// this source tree, so they could not be converted to the same
+// Handshaker-based Accept as part of this change; they should be
+// revisited the same way if/when they are added here.
 package ipc
 
 import (
+	"context"
+	"errors"
 	"net"
+	"runtime"
+	"time"
 
 	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
 	"nanomsg.org/go-mangos"
 	"nanomsg.org/go-mangos/transport"
 )
@@ -45,6 +58,53 @@ const (
 	// This is only for Listeners, and must be set before the
 	// Listener is started.
 	OptionOutputBufferSize = "WIN-IPC-OUTPUT-BUFFER-SIZE"
+
+	// OptionHandshakeTimeout represents how long a newly accepted
+	// pipe is given to complete the SP handshake before it is
+	// abandoned (type time.Duration).  This is only for Listeners,
+	// and must be set before the Listener is started.  A value of
+	// zero (the default) means wait forever.
+	OptionHandshakeTimeout = "WIN-IPC-HANDSHAKE-TIMEOUT"
+
+	// OptionMessageMode puts the Windows Named Pipe into message
+	// mode (bool) rather than the default byte-stream mode.  This
+	// is only for Listeners, and must be set before the Listener is
+	// started.
+	OptionMessageMode = "WIN-IPC-MESSAGE-MODE"
+
+	// OptionDialTimeout represents how long a Dialer will wait for
+	// the named pipe to connect before giving up with
+	// winio.ErrTimeout (type time.Duration).  This is only for
+	// Dialers.  A value of zero (the default) means wait forever:
+	// winio.DialPipe itself defaults to a 2-second timeout when
+	// given a nil duration, so Dial calls winio.DialPipeContext
+	// directly with an undeadlined context.Background() to get the
+	// documented forever-wait.
+	OptionDialTimeout = "WIN-IPC-DIAL-TIMEOUT"
+
+	// OptionPipeImpersonate, when set to true on a Listener before
+	// it is started, causes the listener to impersonate the client
+	// on each accepted pipe long enough to capture its identity.
+	// The resulting SID is then available via OptionPeerSID on the
+	// Pipe returned from Accept.
+	OptionPipeImpersonate = "WIN-IPC-IMPERSONATE"
+
+	// OptionPeerSID is a read-only option, retrievable via GetProp
+	// on a Pipe accepted with OptionPipeImpersonate set, containing
+	// the string SID (e.g. "S-1-5-21-...") of the connecting client.
+	OptionPeerSID = "WIN-IPC-PEER-SID"
+
+	// OptionRecvDeadline sets a deadline (type time.Duration) that is
+	// armed before every Recv on a Pipe and disarmed afterward.  If
+	// the deadline expires, the pipe is closed and the Recv fails
+	// with mangos.ErrRecvTimeout.  A value of zero (the default)
+	// means no deadline.
+	OptionRecvDeadline = "WIN-IPC-RECV-DEADLINE"
+
+	// OptionSendDeadline is the Send-side equivalent of
+	// OptionRecvDeadline; on expiry the pipe is closed and the Send
+	// fails with mangos.ErrSendTimeout.
+	OptionSendDeadline = "WIN-IPC-SEND-DEADLINE"
 )
 
 type pipeAddr string
@@ -57,6 +117,63 @@ func (p pipeAddr) String() string {
 	return string(p)
 }
 
+// deadlinePipe wraps a mangos.TranPipe to arm one absolute deadline per
+// logical Recv/Send call and disarm it afterward, turning a timeout
+// into the same errors the tcp transport reports rather than a generic
+// os error.
+//
+// The deadline is armed on the underlying net.Conn around the whole
+// call to the embedded Recv/Send, not around the individual Read/Write
+// syscalls the wire protocol issues to exchange one message (a marker
+// byte, an 8-byte length, then the body).  Arming it per syscall instead
+// would let a peer that trickles a byte in just under the timeout keep
+// a single logical message alive forever.
+type deadlinePipe struct {
+	mangos.TranPipe
+	conn        net.Conn
+	recvTimeout time.Duration
+	sendTimeout time.Duration
+}
+
+func (p *deadlinePipe) Recv() (*mangos.Message, error) {
+	if p.recvTimeout > 0 {
+		p.conn.SetReadDeadline(time.Now().Add(p.recvTimeout))
+		defer p.conn.SetReadDeadline(time.Time{})
+	}
+	msg, err := p.TranPipe.Recv()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		p.TranPipe.Close()
+		return nil, mangos.ErrRecvTimeout
+	}
+	return msg, err
+}
+
+func (p *deadlinePipe) Send(msg *mangos.Message) error {
+	if p.sendTimeout > 0 {
+		p.conn.SetWriteDeadline(time.Now().Add(p.sendTimeout))
+		defer p.conn.SetWriteDeadline(time.Time{})
+	}
+	err := p.TranPipe.Send(msg)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		p.TranPipe.Close()
+		return mangos.ErrSendTimeout
+	}
+	return err
+}
+
+// withDeadlines wraps pipe in a deadlinePipe if either deadline option
+// is set to a positive duration in opts; otherwise pipe is returned
+// unchanged.  conn is the net.Conn backing pipe, used to arm the
+// deadlines.
+func withDeadlines(pipe mangos.TranPipe, conn net.Conn, opts map[string]interface{}) mangos.TranPipe {
+	recv, _ := opts[OptionRecvDeadline].(time.Duration)
+	send, _ := opts[OptionSendDeadline].(time.Duration)
+	if recv <= 0 && send <= 0 {
+		return pipe
+	}
+	return &deadlinePipe{TranPipe: pipe, conn: conn, recvTimeout: recv, sendTimeout: send}
+}
+
 type dialer struct {
 	path  string
 	proto transport.ProtocolInfo
@@ -66,21 +183,50 @@ type dialer struct {
 // Dial implements the PipeDialer Dial method.
 func (d *dialer) Dial() (transport.Pipe, error) {
 
-	conn, err := winio.DialPipe("\\\\.\\pipe\\"+d.path, nil)
+	ctx := context.Background()
+	if t, ok := d.opts[OptionDialTimeout].(time.Duration); ok && t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+
+	conn, err := winio.DialPipeContext(ctx, "\\\\.\\pipe\\"+d.path)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = winio.ErrTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	p, err := mangos.NewConnPipeIPC(conn, d.proto, d.opts)
 	if err != nil {
 		return nil, err
 	}
-	addr := pipeAddr(d.path)
-	return mangos.NewConnPipeIPC(conn, d.proto, d.opts)
+	return withDeadlines(p, conn, d.opts), nil
 }
 
-// SetOption implements a stub PipeDialer SetOption method.
+// SetOption implements the PipeDialer SetOption method.
 func (d *dialer) SetOption(n string, v interface{}) error {
-	return mangos.ErrBadOption
+	switch n {
+	case OptionDialTimeout:
+		fallthrough
+	case OptionRecvDeadline:
+		fallthrough
+	case OptionSendDeadline:
+		if t, ok := v.(time.Duration); ok {
+			d.opts[n] = t
+			return nil
+		}
+		return mangos.ErrBadValue
+	default:
+		return mangos.ErrBadOption
+	}
 }
 
-// GetOption implements a stub PipeDialer GetOption method.
+// GetOption implements the PipeDialer GetOption method.
 func (d *dialer) GetOption(n string) (interface{}, error) {
+	if v, ok := d.opts[n]; ok {
+		return v, nil
+	}
 	return nil, mangos.ErrBadOption
 }
 
@@ -106,26 +252,37 @@ func (o listenerOptions) set(string, interface{}) error {
 }
 
 type listener struct {
-	path     string
-	sock     mangos.Socket
-	listener net.Listener
+	path       string
+	proto      transport.ProtocolInfo
+	sock       mangos.Socket
+	opts       map[string]interface{}
+	listener   net.Listener
+	handshaker *transport.Handshaker
 }
 
-// Listen implements the PipeListener Listen method.
+// Listen implements the PipeListener Listen method.  If l.listener was
+// already installed (see NewListenerFromHandle), the pipe is assumed to
+// have been pre-created by our caller and this just starts accepting on
+// it; otherwise a new named pipe is created as usual.
 func (l *listener) Listen() error {
 
-	config := &winio.PipeConfig{
-		InputBufferSize:    l.opts[OptionInputBufferSize].(int32),
-		OutputBufferSize:   l.opts[OptionOutputBufferSize].(int32),
-		SecurityDescriptor: l.opts[OptionSecurityDescriptor].(string),
-		MessageMode:        false,
-	}
+	if l.listener == nil {
+		config := &winio.PipeConfig{
+			InputBufferSize:    l.opts[OptionInputBufferSize].(int32),
+			OutputBufferSize:   l.opts[OptionOutputBufferSize].(int32),
+			SecurityDescriptor: l.opts[OptionSecurityDescriptor].(string),
+			MessageMode:        l.opts[OptionMessageMode].(bool),
+		}
 
-	listener, err := winio.ListenPipe("\\\\.\\pipe\\"+l.path, config)
-	if err != nil {
-		return err
+		listener, err := winio.ListenPipe("\\\\.\\pipe\\"+l.path, config)
+		if err != nil {
+			return err
+		}
+		l.listener = listener
 	}
-	l.listener = listener
+
+	l.handshaker = transport.NewHandshaker(l.opts[OptionHandshakeTimeout].(time.Duration))
+	go l.acceptLoop()
 	return nil
 }
 
@@ -133,15 +290,117 @@ func (l *listener) Address() string {
 	return "ipc://" + l.path
 }
 
-// Accept implements the the PipeListener Accept method.
-func (l *listener) Accept() (mangos.TranPipe, error) {
+// acceptLoop accepts raw, unhandshaked pipes as fast as Windows will
+// hand them to us, and queues each one with the Handshaker.  This keeps
+// a peer that connects and then goes silent from stalling Accept.
+func (l *listener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.handshaker.Close()
+			return
+		}
+		impersonate, _ := l.opts[OptionPipeImpersonate].(bool)
+		l.handshaker.Start(conn, func() (mangos.TranPipe, error) {
+			opts := l.opts
+			if impersonate {
+				// ImpersonateNamedPipeClient/OpenThreadToken carry no
+				// timeout of their own, so a peer that makes them hang
+				// must not be allowed to do so on the shared accept
+				// goroutine; this closure already runs on its own
+				// goroutine courtesy of the Handshaker, same as the SP
+				// negotiation itself.
+				sid, err := peerSID(conn)
+				if err != nil {
+					// OptionPipeImpersonate exists so callers can make
+					// ACL/trust decisions on the verified peer identity;
+					// silently falling back to an unidentified pipe here
+					// would make "impersonation requested but failed"
+					// indistinguishable from "impersonation never
+					// requested", defeating the option's purpose.  Drop
+					// the pipe instead.
+					conn.Close()
+					return nil, err
+				}
+				opts = make(map[string]interface{}, len(l.opts)+1)
+				for k, v := range l.opts {
+					opts[k] = v
+				}
+				opts[OptionPeerSID] = sid
+			}
+			p, err := mangos.NewConnPipeIPCNoHandshake(conn, l.proto, opts)
+			if err != nil {
+				return nil, err
+			}
+			return withDeadlines(p, conn, opts), nil
+		})
+	}
+}
+
+var (
+	modadvapi32                    = windows.NewLazySystemDLL("advapi32.dll")
+	procImpersonateNamedPipeClient = modadvapi32.NewProc("ImpersonateNamedPipeClient")
+)
 
-	conn, err := l.listener.Accept()
+// impersonateNamedPipeClient wraps the advapi32 ImpersonateNamedPipeClient
+// call.  golang.org/x/sys/windows exports RevertToSelf and
+// OpenThreadToken but, like go-winio's own privilege.go, has to reach
+// for the raw syscall for this one since it isn't part of that
+// package's exported surface.
+func impersonateNamedPipeClient(handle windows.Handle) error {
+	r1, _, e1 := procImpersonateNamedPipeClient.Call(uintptr(handle))
+	if r1 == 0 {
+		return e1
+	}
+	return nil
+}
+
+// peerSID briefly impersonates the client on the other end of conn in
+// order to capture its string SID, then reverts.  conn must be a
+// *winio.PipeConn (or equivalent) backed by an open named pipe handle.
+//
+// Impersonate/OpenThreadToken/RevertToSelf are thread-affine Win32
+// calls, so the calling goroutine is pinned to its OS thread for the
+// duration: if the scheduler migrated it between Impersonate and
+// RevertToSelf, OpenThreadToken could silently read the wrong token and
+// RevertToSelf would leave some other, unrelated goroutine's thread
+// impersonating the client.
+func peerSID(conn net.Conn) (string, error) {
+	type handleConn interface {
+		Fd() uintptr
+	}
+	hc, ok := conn.(handleConn)
+	if !ok {
+		return "", mangos.ErrBadValue
+	}
+	handle := windows.Handle(hc.Fd())
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := impersonateNamedPipeClient(handle); err != nil {
+		return "", err
+	}
+	defer windows.RevertToSelf()
+
+	var token windows.Token
+	if err := windows.OpenThreadToken(windows.CurrentThread(), windows.TOKEN_QUERY, true, &token); err != nil {
+		return "", err
+	}
+	defer token.Close()
+
+	user, err := token.GetTokenUser()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	addr := pipeAddr(l.path)
-	return transport.NewConnPipeIPC(conn, l.proto, l.opts)
+	return user.User.Sid.String(), nil
+}
+
+// Accept implements the the PipeListener Accept method.  It yields the
+// next pipe for which the SP handshake has already completed; pipes
+// whose handshake times out or fails are never returned here.
+func (l *listener) Accept() (mangos.TranPipe, error) {
+	return l.handshaker.Next()
 }
 
 // Close implements the PipeListener Close method.
@@ -149,6 +408,9 @@ func (l *listener) Close() error {
 	if l.listener != nil {
 		l.listener.Close()
 	}
+	if l.handshaker != nil {
+		l.handshaker.Close()
+	}
 	return nil
 }
 
@@ -171,6 +433,31 @@ func (l *listener) SetOption(name string, val interface{}) error {
 		}
 		return mangos.ErrBadValue
 
+	case OptionHandshakeTimeout:
+		if v, ok := val.(time.Duration); ok {
+			l.opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case OptionMessageMode:
+		fallthrough
+	case OptionPipeImpersonate:
+		if v, ok := val.(bool); ok {
+			l.opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
+	case OptionRecvDeadline:
+		fallthrough
+	case OptionSendDeadline:
+		if v, ok := val.(time.Duration); ok {
+			l.opts[name] = v
+			return nil
+		}
+		return mangos.ErrBadValue
+
 	case mangos.OptionMaxRecvSize:
 		if v, ok := val.(int64); ok {
 			l.opts[name] = v
@@ -211,6 +498,9 @@ func (t *ipcTran) NewDialer(addr string, sock mangos.Socket) (mangos.TranDialer,
 		opts:  make(map[string]interface{}),
 	}
 
+	d.opts[OptionDialTimeout] = time.Duration(0)
+	d.opts[OptionRecvDeadline] = time.Duration(0)
+	d.opts[OptionSendDeadline] = time.Duration(0)
 	d.opts[mangos.OptionLocalAddr] = addr
 	d.opts[mangos.OptionRemoteAddr] = addr
 	d.opts[mangos.OptionMaxRecvSize] = int64(0)
@@ -235,6 +525,11 @@ func (t *ipcTran) NewListener(addr string, sock mangos.Socket) (transport.Listen
 	l.opts[OptionInputBufferSize] = int32(4096)
 	l.opts[OptionOutputBufferSize] = int32(4096)
 	l.opts[OptionSecurityDescriptor] = ""
+	l.opts[OptionHandshakeTimeout] = time.Duration(0)
+	l.opts[OptionMessageMode] = false
+	l.opts[OptionPipeImpersonate] = false
+	l.opts[OptionRecvDeadline] = time.Duration(0)
+	l.opts[OptionSendDeadline] = time.Duration(0)
 	l.opts[mangos.OptionLocalAddr] = addr
 	l.opts[mangos.OptionRemoteAddr] = addr
 	l.opts[mangos.OptionMaxRecvSize] = int64(0)
@@ -246,3 +541,37 @@ func (t *ipcTran) NewListener(addr string, sock mangos.Socket) (transport.Listen
 func NewTransport() transport.Transport {
 	return &ipcTran{}
 }
+
+// NewListenerFromHandle creates an ipc Listener around pl, an already
+// listening net.Listener for a named pipe, such as one a supervisor
+// process pre-created (with whatever ACL it saw fit) and handed down
+// as part of socket activation.  go-winio does not expose a way to
+// turn a raw handle into a net.Listener itself, so building pl from an
+// inherited handle (e.g. via a small wrapper around the win32 handle
+// using golang.org/x/sys/windows) is the caller's responsibility; this
+// function only installs the already-built listener.  Since pl is
+// assumed to already be listening, this function does not create a
+// pipe of its own, so OptionSecurityDescriptor, OptionInputBufferSize,
+// OptionOutputBufferSize and OptionMessageMode have no effect on a
+// Listener built this way.  As with any other Listener, Listen must still be called before
+// Accept.
+func NewListenerFromHandle(pl net.Listener, sock mangos.Socket) (transport.Listener, error) {
+	l := &listener{
+		proto:    sock.Info(),
+		path:     "@handle",
+		sock:     sock,
+		opts:     make(map[string]interface{}),
+		listener: pl,
+	}
+
+	l.opts[OptionHandshakeTimeout] = time.Duration(0)
+	l.opts[OptionMessageMode] = false
+	l.opts[OptionPipeImpersonate] = false
+	l.opts[OptionRecvDeadline] = time.Duration(0)
+	l.opts[OptionSendDeadline] = time.Duration(0)
+	l.opts[mangos.OptionLocalAddr] = l.Address()
+	l.opts[mangos.OptionRemoteAddr] = l.Address()
+	l.opts[mangos.OptionMaxRecvSize] = int64(0)
+
+	return l, nil
+}
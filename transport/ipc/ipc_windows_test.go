@@ -0,0 +1,282 @@
+// +build windows
+
+// Copyright 2018 The Mangos Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"nanomsg.org/go-mangos"
+	"nanomsg.org/go-mangos/transport"
+)
+
+// fakeNetConn is a net.Conn stand-in that only needs to record the
+// deadlines deadlinePipe arms on it and whether it was closed; none of
+// the other net.Conn methods are exercised by deadlinePipe.
+type fakeNetConn struct {
+	net.Conn
+	readDeadlines, writeDeadlines []time.Time
+	closed                        bool
+}
+
+func (c *fakeNetConn) SetReadDeadline(t time.Time) error {
+	c.readDeadlines = append(c.readDeadlines, t)
+	return nil
+}
+
+func (c *fakeNetConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadlines = append(c.writeDeadlines, t)
+	return nil
+}
+
+func (c *fakeNetConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// fakeTranPipe is a stand-in for the mangos.TranPipe a real handshake
+// would yield; Recv/Send return whatever was configured so tests can
+// drive deadlinePipe's error handling.
+type fakeTranPipe struct {
+	recvErr, sendErr error
+	closed           bool
+}
+
+func (p *fakeTranPipe) Recv() (*mangos.Message, error) { return nil, p.recvErr }
+func (p *fakeTranPipe) Send(*mangos.Message) error     { return p.sendErr }
+func (p *fakeTranPipe) LocalProtocol() uint16          { return 0 }
+func (p *fakeTranPipe) RemoteProtocol() uint16         { return 0 }
+func (p *fakeTranPipe) IsOpen() bool                   { return !p.closed }
+func (p *fakeTranPipe) GetProp(string) (interface{}, error) {
+	return nil, mangos.ErrBadOption
+}
+func (p *fakeTranPipe) Close() error {
+	p.closed = true
+	return nil
+}
+
+// fakeTimeoutErr is a net.Error whose Timeout() is always true, standing
+// in for the error winio's deadline machinery returns on expiry.
+type fakeTimeoutErr struct{}
+
+func (fakeTimeoutErr) Error() string   { return "i/o timeout" }
+func (fakeTimeoutErr) Timeout() bool   { return true }
+func (fakeTimeoutErr) Temporary() bool { return true }
+
+func TestWithDeadlinesReturnsPipeUnchangedWhenUnset(t *testing.T) {
+	pipe := &fakeTranPipe{}
+	opts := map[string]interface{}{
+		OptionRecvDeadline: time.Duration(0),
+		OptionSendDeadline: time.Duration(0),
+	}
+	if got := withDeadlines(pipe, &fakeNetConn{}, opts); got != pipe {
+		t.Fatalf("withDeadlines() = %v, want the original pipe unwrapped", got)
+	}
+}
+
+func TestDeadlinePipeRecvArmsAndDisarmsReadDeadline(t *testing.T) {
+	conn := &fakeNetConn{}
+	pipe := &fakeTranPipe{}
+	dp := withDeadlines(pipe, conn, map[string]interface{}{
+		OptionRecvDeadline: 50 * time.Millisecond,
+	})
+
+	if _, err := dp.Recv(); err != nil {
+		t.Fatalf("Recv() error = %v, want nil", err)
+	}
+	if len(conn.readDeadlines) != 2 {
+		t.Fatalf("SetReadDeadline called %d times, want 2 (arm, disarm)", len(conn.readDeadlines))
+	}
+	if conn.readDeadlines[0].IsZero() {
+		t.Fatal("first SetReadDeadline call armed a zero deadline")
+	}
+	if !conn.readDeadlines[1].IsZero() {
+		t.Fatal("second SetReadDeadline call did not disarm the deadline")
+	}
+}
+
+func TestDeadlinePipeRecvTimeoutClosesPipeAndReturnsErrRecvTimeout(t *testing.T) {
+	pipe := &fakeTranPipe{recvErr: fakeTimeoutErr{}}
+	dp := withDeadlines(pipe, &fakeNetConn{}, map[string]interface{}{
+		OptionRecvDeadline: time.Millisecond,
+	})
+
+	_, err := dp.Recv()
+	if err != mangos.ErrRecvTimeout {
+		t.Fatalf("Recv() error = %v, want mangos.ErrRecvTimeout", err)
+	}
+	if !pipe.closed {
+		t.Fatal("Recv() timeout did not close the pipe")
+	}
+}
+
+func TestDeadlinePipeSendArmsAndDisarmsWriteDeadline(t *testing.T) {
+	conn := &fakeNetConn{}
+	pipe := &fakeTranPipe{}
+	dp := withDeadlines(pipe, conn, map[string]interface{}{
+		OptionSendDeadline: 50 * time.Millisecond,
+	})
+
+	if err := dp.Send(&mangos.Message{}); err != nil {
+		t.Fatalf("Send() error = %v, want nil", err)
+	}
+	if len(conn.writeDeadlines) != 2 {
+		t.Fatalf("SetWriteDeadline called %d times, want 2 (arm, disarm)", len(conn.writeDeadlines))
+	}
+	if conn.writeDeadlines[0].IsZero() {
+		t.Fatal("first SetWriteDeadline call armed a zero deadline")
+	}
+	if !conn.writeDeadlines[1].IsZero() {
+		t.Fatal("second SetWriteDeadline call did not disarm the deadline")
+	}
+}
+
+func TestDeadlinePipeSendTimeoutClosesPipeAndReturnsErrSendTimeout(t *testing.T) {
+	pipe := &fakeTranPipe{sendErr: fakeTimeoutErr{}}
+	dp := withDeadlines(pipe, &fakeNetConn{}, map[string]interface{}{
+		OptionSendDeadline: time.Millisecond,
+	})
+
+	err := dp.Send(&mangos.Message{})
+	if err != mangos.ErrSendTimeout {
+		t.Fatalf("Send() error = %v, want mangos.ErrSendTimeout", err)
+	}
+	if !pipe.closed {
+		t.Fatal("Send() timeout did not close the pipe")
+	}
+}
+
+func TestDialerSetOptionValidatesTypes(t *testing.T) {
+	for _, name := range []string{OptionDialTimeout, OptionRecvDeadline, OptionSendDeadline} {
+		d := &dialer{opts: make(map[string]interface{})}
+		if err := d.SetOption(name, "not a duration"); err != mangos.ErrBadValue {
+			t.Errorf("SetOption(%s, wrong type) = %v, want mangos.ErrBadValue", name, err)
+		}
+		if err := d.SetOption(name, time.Second); err != nil {
+			t.Errorf("SetOption(%s, time.Duration) = %v, want nil", name, err)
+		}
+		if v, _ := d.GetOption(name); v != time.Second {
+			t.Errorf("GetOption(%s) = %v, want time.Second", name, v)
+		}
+	}
+	d := &dialer{opts: make(map[string]interface{})}
+	if err := d.SetOption("bogus", true); err != mangos.ErrBadOption {
+		t.Errorf("SetOption(unknown) = %v, want mangos.ErrBadOption", err)
+	}
+}
+
+func TestListenerSetOptionValidatesTypes(t *testing.T) {
+	boolOpts := []string{OptionMessageMode, OptionPipeImpersonate}
+	durationOpts := []string{OptionHandshakeTimeout, OptionRecvDeadline, OptionSendDeadline}
+
+	for _, name := range boolOpts {
+		l := &listener{opts: make(map[string]interface{})}
+		if err := l.SetOption(name, "not a bool"); err != mangos.ErrBadValue {
+			t.Errorf("SetOption(%s, wrong type) = %v, want mangos.ErrBadValue", name, err)
+		}
+		if err := l.SetOption(name, true); err != nil {
+			t.Errorf("SetOption(%s, bool) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range durationOpts {
+		l := &listener{opts: make(map[string]interface{})}
+		if err := l.SetOption(name, "not a duration"); err != mangos.ErrBadValue {
+			t.Errorf("SetOption(%s, wrong type) = %v, want mangos.ErrBadValue", name, err)
+		}
+		if err := l.SetOption(name, time.Second); err != nil {
+			t.Errorf("SetOption(%s, time.Duration) = %v, want nil", name, err)
+		}
+	}
+
+	l := &listener{opts: make(map[string]interface{})}
+	if err := l.SetOption("bogus", true); err != mangos.ErrBadOption {
+		t.Errorf("SetOption(unknown) = %v, want mangos.ErrBadOption", err)
+	}
+}
+
+// fakeSocket is a minimal mangos.Socket stand-in; Info() is the only
+// method the listener/dialer constructors call.
+type fakeSocket struct{}
+
+func (fakeSocket) Info() transport.ProtocolInfo { return transport.ProtocolInfo{} }
+
+// fakeNetListener is a net.Listener stand-in for a pre-created pipe
+// handed down by a supervisor; Accept always fails so acceptLoop exits
+// immediately instead of blocking the test.
+type fakeNetListener struct{}
+
+func (fakeNetListener) Accept() (net.Conn, error) {
+	return nil, errors.New("fakeNetListener: no connections")
+}
+func (fakeNetListener) Close() error   { return nil }
+func (fakeNetListener) Addr() net.Addr { return pipeAddr("fake") }
+
+func TestNewListenerFromHandleInstallsProvidedListener(t *testing.T) {
+	pl := fakeNetListener{}
+	tl, err := NewListenerFromHandle(pl, fakeSocket{})
+	if err != nil {
+		t.Fatalf("NewListenerFromHandle() error = %v", err)
+	}
+	l, ok := tl.(*listener)
+	if !ok {
+		t.Fatalf("NewListenerFromHandle() returned %T, want *listener", tl)
+	}
+	if l.listener != pl {
+		t.Fatal("NewListenerFromHandle() did not install the caller-provided net.Listener")
+	}
+	if got, want := l.Address(), "ipc://@handle"; got != want {
+		t.Errorf("Address() = %q, want %q", got, want)
+	}
+
+	defaults := map[string]interface{}{
+		OptionHandshakeTimeout: time.Duration(0),
+		OptionMessageMode:      false,
+		OptionPipeImpersonate:  false,
+		OptionRecvDeadline:     time.Duration(0),
+		OptionSendDeadline:     time.Duration(0),
+	}
+	for name, want := range defaults {
+		if got, err := l.GetOption(name); err != nil || got != want {
+			t.Errorf("GetOption(%s) = %v, %v; want %v, nil", name, got, err, want)
+		}
+	}
+}
+
+func TestNewListenerFromHandleListenSkipsListenPipe(t *testing.T) {
+	pl := fakeNetListener{}
+	tl, err := NewListenerFromHandle(pl, fakeSocket{})
+	if err != nil {
+		t.Fatalf("NewListenerFromHandle() error = %v", err)
+	}
+	l := tl.(*listener)
+
+	// If Listen tried to create its own pipe here (as it does when
+	// l.listener is nil), it would dereference the unset
+	// OptionInputBufferSize/OptionOutputBufferSize/
+	// OptionSecurityDescriptor options and panic; reaching Close
+	// without a panic confirms the caller-provided listener was used
+	// as-is.
+	if err := l.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	l.Close()
+	if l.listener != pl {
+		t.Fatal("Listen() replaced the caller-provided net.Listener")
+	}
+}